@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object describes one archive file returned by ArchiveBackend.List.
+type Object struct {
+	Name    string // key relative to the backend's root, forward-slash separated
+	Size    int64
+	ModTime time.Time
+}
+
+// ArchiveBackend is where rotated archive tars and their .idx sidecars live.
+// All names/prefixes are forward-slash-separated keys relative to the
+// backend's root, never host file paths, so archiveWriter and
+// handleImageRequest work unchanged whether the backend is local disk or an
+// object store.
+type ArchiveBackend interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReaderAt, int64, error)
+	List(prefix string) ([]Object, error)
+}
+
+// closeIfCloser closes ra if it also implements io.Closer. ArchiveBackend.Open
+// returns a bare io.ReaderAt because not every backend needs closing (an S3
+// range-reader doesn't hold a handle open between calls), but local files do.
+func closeIfCloser(ra io.ReaderAt) {
+	if c, ok := ra.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// localBackend implements ArchiveBackend on a local (or NFS-mounted) directory tree.
+type localBackend struct {
+	root string
+}
+
+func newLocalBackend(root string) *localBackend {
+	return &localBackend{root: root}
+}
+
+func (b *localBackend) Create(name string) (io.WriteCloser, error) {
+	fullPath := filepath.Join(b.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(fullPath)
+}
+
+func (b *localBackend) Open(name string) (io.ReaderAt, int64, error) {
+	f, err := os.Open(filepath.Join(b.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (b *localBackend) List(prefix string) ([]Object, error) {
+	dir := filepath.Join(b.root, filepath.FromSlash(prefix))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	objects := make([]Object, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, Object{
+			Name:    path.Join(prefix, e.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// envDefault returns the value of the environment variable key, or fallback
+// if it's unset, so flags like --archive-backend can also be set via e.g.
+// ARCHIVE_BACKEND without pulling in a flags/env library.
+func envDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// trimSlashes strips any leading/trailing "/" from a key prefix.
+func trimSlashes(s string) string {
+	return strings.Trim(s, "/")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Backend implements ArchiveBackend against an S3-compatible object store.
+// Writes stream up via multipart upload as Write is called instead of
+// buffering a whole 60-second tar in memory; reads fetch byte ranges on
+// demand so a single-frame lookup doesn't download the whole tar.
+//
+// Known limitation: an object written through Create isn't visible to
+// Open/List until its upload completes on Close, unlike localBackend, where
+// a reader sees a file's bytes as they're written. idx.go's loadIndex is
+// designed around being able to read the sidecar for the tar archiveWriter
+// currently has open (the common case for "most recent" /image lookups),
+// which holds for the local backend but not this one: until the in-progress
+// tar rotates or the stream ends, lookups that fall inside it are answered
+// from the newest completed tar (its last frame, older than the requested
+// time), or 404 if the stream has no completed tar yet.
+type s3Backend struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Backend(client *s3.Client, bucket, prefix string) *s3Backend {
+	return &s3Backend{client: client, bucket: bucket, prefix: trimSlashes(prefix)}
+}
+
+func (b *s3Backend) key(name string) string {
+	if b.prefix == "" {
+		return name
+	}
+	return path.Join(b.prefix, name)
+}
+
+func (b *s3Backend) Create(name string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	key := b.key(name)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := manager.NewUploader(b.client).Upload(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return &s3Writer{pw: pw, done: done}, nil
+}
+
+// s3Writer adapts the io.Pipe feeding manager.Uploader into an io.WriteCloser;
+// Close blocks until the multipart upload started in Create has completed.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) { return w.pw.Write(p) }
+
+func (w *s3Writer) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+func (b *s3Backend) Open(name string) (io.ReaderAt, int64, error) {
+	key := b.key(name)
+	head, err := b.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &s3ReaderAt{client: b.client, bucket: b.bucket, key: key}, aws.ToInt64(head.ContentLength), nil
+}
+
+// s3ReaderAt fetches each ReadAt call as its own ranged GetObject; it holds
+// no open handle between calls, so callers don't need to close it.
+type s3ReaderAt struct {
+	client *s3.Client
+	bucket string
+	key    string
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	out, err := r.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+	return io.ReadFull(out.Body, p)
+}
+
+func (b *s3Backend) List(prefix string) ([]Object, error) {
+	fullPrefix := b.key(prefix) + "/"
+
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(fullPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), trimSlashes(b.prefix)+"/")
+			objects = append(objects, Object{
+				Name:    name,
+				Size:    aws.ToInt64(obj.Size),
+				ModTime: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
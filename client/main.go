@@ -5,12 +5,7 @@ import (
 	"bytes"
 	"context"
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
-	"net/http"
-	"net/textproto"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -18,6 +13,18 @@ import (
 	"time"
 )
 
+// frame is one decoded JPEG frame read from ffmpeg's stdout, stamped with the
+// wall-clock time it was captured.
+type frame struct {
+	TimestampMs int64
+	Data        []byte
+}
+
+// frameRingSize is how many frames the publisher buffers across a reconnect
+// (~1-2s of video at the 5fps ffmpeg emits), so a brief network blip doesn't
+// lose the frames captured while we're re-establishing the connection.
+const frameRingSize = 10
+
 // scanJPEG is a custom split function for bufio.Scanner. It finds the EOI
 // (End of Image) marker in a stream of JPEG data to split the stream into
 // individual frames.
@@ -41,6 +48,24 @@ func scanJPEG(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
+// pushFrame sends f to ch, dropping the oldest buffered frame to make room
+// if the ring is full rather than blocking the ffmpeg-reading goroutine.
+func pushFrame(ch chan frame, f frame) {
+	select {
+	case ch <- f:
+		return
+	default:
+	}
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- f:
+	default:
+	}
+}
+
 func main() {
 	log.Println("--- Go MJPEG Multipart Streamer ---")
 
@@ -48,6 +73,8 @@ func main() {
 	cameraID := flag.String("camera-id", "", "Unique ID of the camera device to use.")
 	streamURL := flag.String("url", "http://localhost:8080/stream", "URL of the MJPEG service.")
 	verbose := flag.Bool("verbose", false, "Enable verbose ffmpeg logs.")
+	authToken := flag.String("auth-token", "", "Bearer token sent as the Authorization header on the stream POST.")
+	tlsCA := flag.String("tls-ca", "", "Path to a PEM-encoded CA certificate to verify the server's TLS certificate against.")
 	flag.Parse()
 
 	if *cameraID == "" {
@@ -93,41 +120,23 @@ func main() {
 		log.Fatalf("Failed to start ffmpeg: %v", err)
 	}
 
-	// --- 4. Set up the Streaming HTTP POST Request ---
-	// We use an io.Pipe to connect our multipart writer directly to the HTTP
-	// request body, avoiding buffering the entire stream in memory.
-	pr, pw := io.Pipe()
-	defer pr.Close()
-	defer pw.Close()
-
-	mpWriter := multipart.NewWriter(pw)
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *streamURL+"/"+streamKey, pr)
-	if err != nil {
-		log.Fatalf("Failed to create HTTP request: %v", err)
-	}
-	// Set the Content-Type with the correct multipart boundary.
-	req.Header.Set("Content-Type", mpWriter.FormDataContentType())
+	// --- 4. Start the resilient publisher ---
+	// frameCh decouples ffmpeg's output from the HTTP session: the publisher
+	// can drop a connection and reconnect with a fresh request without ever
+	// pausing ffmpeg. While no session is sending, only the newest
+	// frameRingSize frames are kept; older ones are dropped.
+	frameCh := make(chan frame, frameRingSize)
 
-	// Use a channel to wait for the HTTP request to finish.
-	httpDone := make(chan struct{})
+	publisherDone := make(chan struct{})
 	go func() {
-		defer close(httpDone)
-		log.Println("Starting HTTP POST...")
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			if ctx.Err() == nil { // Don't log error if we cancelled the context
-				log.Printf("HTTP request failed: %v", err)
-			}
-			return
-		}
-		defer resp.Body.Close()
-		log.Printf("HTTP response received: %s", resp.Status)
-		// Drain the response body to allow connection reuse.
-		io.Copy(io.Discard, resp.Body)
+		defer close(publisherDone)
+		publishStream(ctx, *streamURL+"/"+streamKey, publisherConfig{
+			authToken: *authToken,
+			tlsCAPath: *tlsCA,
+		}, frameCh)
 	}()
 
-	// --- 5. Main Loop: Scan, Timestamp, and Stream Frames ---
+	// --- 5. Main Loop: Scan, Timestamp, and Buffer Frames ---
 	// The scanner reads from ffmpeg's stdout, using our custom split function
 	// to identify individual JPEG frames.
 	scanner := bufio.NewScanner(ffmpegStdout)
@@ -136,29 +145,18 @@ func main() {
 	scanner.Buffer(make([]byte, 2*1024*1024), 4*1024*1024)
 
 	var frameCount int
+	scanDone := make(chan struct{})
 	go func() {
+		defer close(scanDone)
 		for scanner.Scan() {
 			frameBytes := scanner.Bytes()
 			if len(frameBytes) == 0 {
 				continue
 			}
 
-			// Create a new part in the multipart stream
-			part, err := mpWriter.CreatePart(textproto.MIMEHeader{
-				"Content-Type":       []string{"image/jpeg"},
-				"X-Client-Timestamp": []string{fmt.Sprintf("%d", time.Now().UnixMilli())},
-			})
-
-			if err != nil {
-				log.Printf("Failed to create multipart part: %v", err)
-				break
-			}
-
-			// Write the JPEG data to the part
-			if _, err := part.Write(frameBytes); err != nil {
-				log.Printf("Failed to write frame to multipart part: %v", err)
-				break
-			}
+			data := make([]byte, len(frameBytes))
+			copy(data, frameBytes)
+			pushFrame(frameCh, frame{TimestampMs: time.Now().UnixMilli(), Data: data})
 			frameCount++
 		}
 
@@ -167,10 +165,6 @@ func main() {
 				log.Printf("Error reading from ffmpeg stdout: %v", err)
 			}
 		}
-
-		// Once the scanner is done, close the writers to signal the end of the stream.
-		mpWriter.Close()
-		pw.Close()
 	}()
 
 	// --- 6. Wait for everything to finish ---
@@ -186,13 +180,11 @@ func main() {
 		}
 	}
 
-	pr.Close() // Ensure the pipe reader is closed to unblock the HTTP client
+	<-scanDone
+	close(frameCh)
 
-	log.Println("Waiting for HTTP request to complete...")
-	<-httpDone
+	log.Println("Waiting for publisher to finish...")
+	<-publisherDone
 
 	log.Printf("Stream finished. Sent %d frames.", frameCount)
 }
-
-
-
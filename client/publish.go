@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// publisherConfig holds the options that harden the publisher beyond a bare
+// multipart POST: authentication and TLS verification for the connection.
+type publisherConfig struct {
+	authToken string
+	tlsCAPath string
+}
+
+// maxAckLagMs bounds how far behind the server's last acked frame we let
+// ourselves get before we start dropping frames instead of sending them,
+// the client side of the X-Server-Ack backpressure protocol.
+const maxAckLagMs = 2000
+
+// publishStream keeps a stream session to url alive for as long as ctx is
+// not done, reconnecting with exponential backoff on 5xx responses or
+// network errors. frameCh is shared across reconnects, so frames captured
+// while a session is down are sent once the next session starts rather than
+// being lost to anything but the ring buffer's limited depth.
+func publishStream(ctx context.Context, url string, cfg publisherConfig, frameCh <-chan frame) {
+	client, err := newHTTPClient(cfg.tlsCAPath)
+	if err != nil {
+		log.Fatalf("Failed to configure HTTP client: %v", err)
+	}
+
+	const maxBackoff = 30 * time.Second
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		fatal, err := publishSession(ctx, client, url, cfg.authToken, frameCh)
+		if err == nil {
+			return // frameCh closed: the capture side finished cleanly.
+		}
+		if fatal {
+			log.Printf("STREAM: giving up after non-retryable error: %v", err)
+			return
+		}
+
+		log.Printf("STREAM: session ended (%v); reconnecting in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// newHTTPClient builds the HTTP client used for every session, optionally
+// pinned to a private CA for --tls-ca.
+func newHTTPClient(tlsCAPath string) (*http.Client, error) {
+	if tlsCAPath == "" {
+		return http.DefaultClient, nil
+	}
+
+	caCert, err := os.ReadFile(tlsCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read --tls-ca file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in --tls-ca file %s", tlsCAPath)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}, nil
+}
+
+// publishSession runs a single HTTP POST attempt: a fresh io.Pipe carries a
+// fresh multipart body fed from frameCh until the capture side finishes,
+// the server ends the response, or the connection breaks. It reports
+// whether the failure is worth retrying.
+//
+// Return value err == nil means frameCh was closed and fully drained, i.e. a
+// clean shutdown; the caller should not reconnect. A non-nil err with
+// fatal == true means the server rejected the request in a way a retry
+// can't fix (e.g. bad --auth-token); fatal == false means a transient
+// failure (5xx, connection reset) that's worth retrying with backoff.
+func publishSession(ctx context.Context, client *http.Client, url, authToken string, frameCh <-chan frame) (fatal bool, err error) {
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	mpWriter := multipart.NewWriter(pw)
+
+	req, err := http.NewRequestWithContext(sessionCtx, http.MethodPost, url, pr)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", mpWriter.FormDataContentType())
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	var lastAckMs int64
+	feedDone := make(chan error, 1)
+	go func() {
+		ferr := feedFrames(sessionCtx, mpWriter, frameCh, &lastAckMs)
+		mpWriter.Close() // best effort: writes a closing boundary, harmless if pw is already broken
+		pw.Close()
+		feedDone <- ferr
+	}()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		<-feedDone
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		cancel() // stop feedFrames immediately rather than waiting on a dead connection
+		<-feedDone
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode >= 500 {
+			return false, fmt.Errorf("server returned %s", resp.Status)
+		}
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	// Track X-Server-Ack lines until the response ends, which happens once
+	// the server has finished handling this POST.
+	trackServerAcks(resp.Body, &lastAckMs)
+
+	if ferr := <-feedDone; ferr != nil {
+		return false, ferr
+	}
+	return false, nil
+}
+
+// feedFrames reads frames off frameCh and writes each as a multipart part,
+// until frameCh is closed (a clean end of capture) or ctx is cancelled (the
+// session is being torn down for a reconnect). If the server's acked
+// timestamp is falling too far behind, frames are dropped instead of sent so
+// the stream can catch back up to real time.
+func feedFrames(ctx context.Context, mpWriter *multipart.Writer, frameCh <-chan frame, lastAckMs *int64) error {
+	for {
+		select {
+		case f, ok := <-frameCh:
+			if !ok {
+				return nil
+			}
+
+			if ack := atomic.LoadInt64(lastAckMs); ack != 0 && f.TimestampMs-ack > maxAckLagMs {
+				log.Printf("STREAM: server ack lag %dms, dropping frame to catch up", f.TimestampMs-ack)
+				continue
+			}
+
+			part, err := mpWriter.CreatePart(textproto.MIMEHeader{
+				"Content-Type":       []string{"image/jpeg"},
+				"X-Client-Timestamp": []string{strconv.FormatInt(f.TimestampMs, 10)},
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := part.Write(f.Data); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// trackServerAcks reads the chunked "X-Server-Ack: <unixMs>" lines the
+// service writes to its response body while it ingests this stream,
+// updating *lastAckMs so feedFrames can react to growing ack lag. It
+// returns once the response body ends.
+func trackServerAcks(body io.Reader, lastAckMs *int64) {
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		const prefix = "X-Server-Ack: "
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		ms, err := strconv.ParseInt(strings.TrimPrefix(line, prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		atomic.StoreInt64(lastAckMs, ms)
+	}
+}
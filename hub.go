@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Hub fans out the frames of a single in-progress stream to any number of
+// live viewers. A viewer that falls behind has frames dropped rather than
+// blocking the ingest path, the same trade-off the archive channel already
+// makes for the TAR writer.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[chan []byte]struct{}
+}
+
+func newHub() *Hub {
+	return &Hub{subs: make(map[chan []byte]struct{})}
+}
+
+// subscribe registers a new viewer and returns the channel it should read
+// frames from. Callers must call unsubscribe when done viewing.
+func (h *Hub) subscribe() chan []byte {
+	ch := make(chan []byte, 10) // a couple seconds of frames before we start dropping
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *Hub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; !ok {
+		return // already closed by closeAll
+	}
+	delete(h.subs, ch)
+	close(ch)
+}
+
+// closeAll closes every current subscriber's channel, so a viewer blocked
+// on "frame, ok := <-ch" wakes up with ok == false instead of hanging open
+// forever. Called once ingest for this Hub's stream ends.
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+// publish fans a decoded frame out to every subscribed viewer.
+func (h *Hub) publish(frame []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for ch := range h.subs {
+		select {
+		case ch <- frame:
+		default:
+			log.Printf("HUB: viewer channel full, dropping live frame")
+		}
+	}
+}
+
+// hubsMu and hubs track the Hub for each stream that is currently being
+// ingested by handleStream. Streams not present here are not live.
+var (
+	hubsMu sync.RWMutex
+	hubs   = make(map[string]*Hub)
+)
+
+func getOrCreateHub(streamName string) *Hub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	h, ok := hubs[streamName]
+	if !ok {
+		h = newHub()
+		hubs[streamName] = h
+	}
+	return h
+}
+
+func getHub(streamName string) (*Hub, bool) {
+	hubsMu.RLock()
+	defer hubsMu.RUnlock()
+	h, ok := hubs[streamName]
+	return h, ok
+}
+
+// removeHub forgets the Hub for streamName and disconnects every viewer
+// currently subscribed to it, since ingest for the stream has ended and
+// nothing will ever publish to it again.
+func removeHub(streamName string) {
+	hubsMu.Lock()
+	h, ok := hubs[streamName]
+	delete(hubs, streamName)
+	hubsMu.Unlock()
+	if ok {
+		h.closeAll()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// indexEntry is a single fixed-width record in a tar's ".idx" sidecar,
+// locating one frame's data within the tar file. Records are appended in
+// chronological order by archiveWriter, so a sidecar is always sorted by
+// TimestampMs and can be binary-searched.
+type indexEntry struct {
+	TimestampMs int64
+	TarOffset   int64
+	Size        int32
+}
+
+// indexRecordSize is the on-disk size of an indexEntry: binary.Write lays
+// fields out tightly with no padding, so this is exactly 8+8+4 bytes.
+const indexRecordSize = 20
+
+// idxKeyForTar maps a stream's tar archive backend key to its sidecar index key.
+func idxKeyForTar(tarKey string) string {
+	return strings.TrimSuffix(tarKey, ".tar") + ".idx"
+}
+
+// appendIndexRecord appends one fixed-width record to an open idx writer.
+func appendIndexRecord(w io.Writer, e indexEntry) error {
+	return binary.Write(w, binary.LittleEndian, e)
+}
+
+// loadIndex reads and decodes a .idx sidecar via backend, consulting and
+// populating indexCache so repeated queries against the same archive don't
+// re-read the whole sidecar every time.
+//
+// The sidecar for the tar archiveWriter currently has open is still being
+// appended to, and it's exactly the one handleImageRequest picks for
+// "most recent" timestamp queries, so a cache entry can go stale within the
+// same ~60s rotation window it was read in. Rather than skip caching it
+// (the common-case archive), loadIndex always re-checks the backend's
+// current size and, if it grew past what's cached, decodes only the new
+// tail and appends it instead of re-reading the sidecar from scratch.
+func loadIndex(backend ArchiveBackend, idxKey string) ([]indexEntry, error) {
+	ra, size, err := backend.Open(idxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer closeIfCloser(ra)
+
+	if cached, cachedSize, ok := indexCache.get(idxKey); ok {
+		if size <= cachedSize {
+			return cached, nil
+		}
+		tail := make([]byte, size-cachedSize)
+		if _, err := ra.ReadAt(tail, cachedSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+		entries := append(append([]indexEntry{}, cached...), decodeIndexEntries(tail)...)
+		indexCache.put(idxKey, entries, int64(len(entries))*indexRecordSize)
+		return entries, nil
+	}
+
+	raw := make([]byte, size)
+	if _, err := ra.ReadAt(raw, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	entries := decodeIndexEntries(raw)
+	indexCache.put(idxKey, entries, int64(len(entries))*indexRecordSize)
+	return entries, nil
+}
+
+// decodeIndexEntries decodes as many whole indexEntry records as raw holds,
+// silently dropping a trailing partial record (possible if raw was read
+// concurrently with archiveWriter appending to it).
+func decodeIndexEntries(raw []byte) []indexEntry {
+	n := int64(len(raw)) / indexRecordSize
+	entries := make([]indexEntry, 0, n)
+	r := bytes.NewReader(raw)
+	for i := int64(0); i < n; i++ {
+		var e indexEntry
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// findFrame binary-searches entries (sorted ascending by TimestampMs) for the
+// entry with the largest timestamp <= timestampMs.
+func findFrame(entries []indexEntry, timestampMs int64) (indexEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].TimestampMs > timestampMs })
+	if i == 0 {
+		return indexEntry{}, false
+	}
+	return entries[i-1], true
+}
+
+// indexLRU caches decoded sidecar entries keyed by idx path, so repeated
+// lookups against the same archive (e.g. scrubbing through one minute of
+// footage) only decode the sidecar once.
+type indexLRU struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type indexLRUItem struct {
+	key     string
+	entries []indexEntry
+	size    int64 // bytes of the sidecar these entries were decoded from (whole records only)
+}
+
+var indexCache = newIndexLRU(16)
+
+func newIndexLRU(capacity int) *indexLRU {
+	return &indexLRU{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *indexLRU) get(key string) (entries []indexEntry, size int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, 0, false
+	}
+	c.ll.MoveToFront(el)
+	item := el.Value.(*indexLRUItem)
+	return item.entries, item.size, true
+}
+
+func (c *indexLRU) put(key string, entries []indexEntry, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*indexLRUItem).entries = entries
+		el.Value.(*indexLRUItem).size = size
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&indexLRUItem{key: key, entries: entries, size: size})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*indexLRUItem).key)
+		}
+	}
+}
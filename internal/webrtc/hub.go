@@ -0,0 +1,88 @@
+// Package webrtc adds a WHEP (WebRTC-HTTP Egress Protocol) playback path
+// alongside the existing MJPEG live view and HLS ladder: browsers that POST
+// an SDP offer to /whep/:stream_name get sub-second glass-to-glass latency
+// instead of the several-second floor HLS segmenting imposes.
+//
+// It does not touch ingest. Video comes from the H.264 ladder encoder that
+// transcode.go already runs for HLS; that encoder gains one extra output, a
+// raw H.264 elementary stream written to a Unix socket, which Ingest reads
+// and repacketizes into samples. A single Hub per stream fans those samples
+// out to every WHEP viewer, so N viewers of one camera still share the one
+// encoder instance instead of each spawning their own.
+package webrtc
+
+import (
+	"log"
+	"sync"
+
+	pion "github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// Hub fans the access units produced by one stream's H.264 encoder out to
+// every WHEP viewer currently watching it. Unlike hub.go's frame Hub, a
+// slow or closed viewer here doesn't get frames dropped by the Hub itself;
+// TrackLocalStaticSample.WriteSample already discards samples for any
+// track whose viewer isn't reading, so publish never blocks.
+type Hub struct {
+	mu     sync.RWMutex
+	tracks map[*pion.TrackLocalStaticSample]struct{}
+}
+
+func newHub() *Hub {
+	return &Hub{tracks: make(map[*pion.TrackLocalStaticSample]struct{})}
+}
+
+// addTrack registers a viewer's track to start receiving published samples.
+func (h *Hub) addTrack(t *pion.TrackLocalStaticSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tracks[t] = struct{}{}
+}
+
+// removeTrack unregisters a viewer's track, e.g. once its PeerConnection closes.
+func (h *Hub) removeTrack(t *pion.TrackLocalStaticSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.tracks, t)
+}
+
+// publish writes one access unit to every registered viewer track.
+func (h *Hub) publish(sample media.Sample) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for t := range h.tracks {
+		if err := t.WriteSample(sample); err != nil {
+			log.Printf("WEBRTC: failed to write sample to a viewer track: %v", err)
+		}
+	}
+}
+
+// hubsMu and hubs track the Hub for each stream with a running WebRTC
+// ingest goroutine. A stream not present here has no WHEP viewers and no
+// reason to pay for H.264 repacketization.
+var (
+	hubsMu sync.Mutex
+	hubs   = make(map[string]*Hub)
+)
+
+// GetOrCreateHub returns the Hub for streamName, creating it if this is the
+// first WHEP viewer or ingest goroutine to reference it.
+func GetOrCreateHub(streamName string) *Hub {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+	h, ok := hubs[streamName]
+	if !ok {
+		h = newHub()
+		hubs[streamName] = h
+	}
+	return h
+}
+
+// RemoveHub forgets the Hub for streamName. Called once its encoder's
+// ingest goroutine stops, e.g. when reapIdleStreams kills the ladder.
+func RemoveHub(streamName string) {
+	hubsMu.Lock()
+	delete(hubs, streamName)
+	hubsMu.Unlock()
+}
@@ -0,0 +1,123 @@
+package webrtc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// frameDuration is the presentation duration of one access unit, matching
+// the 5fps the ladder encoder runs at (see transcode.go's "-framerate", "5"
+// mjpeg input, the same assumption client/main.go's capture side makes).
+// WriteSample uses this to advance each viewer track's RTP timestamp.
+const frameDuration = 200 * time.Millisecond
+
+// audNALType is the NAL unit type for an Access Unit Delimiter. x264 is
+// asked to emit one (via the "aud=1" x264 param in transcode.go's
+// webrtcArgs) at the start of every access unit, which is what lets Ingest
+// find access unit boundaries in an otherwise undelimited Annex-B stream.
+const audNALType = 9
+
+// Ingest accepts the single connection ffmpeg's "-f h264 unix:" output
+// makes to ln, reads its Annex-B H.264 elementary stream, regroups NAL
+// units into access units, and publishes each as a sample on hub. It
+// returns once ctx is done or the connection errors out; ln is not closed
+// here, the caller owns its lifetime alongside the ffmpeg process writing
+// to it.
+func Ingest(ctx context.Context, ln net.Listener, hub *Hub) {
+	conn, err := ln.Accept()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("WEBRTC: failed to accept ffmpeg's h264 connection: %v", err)
+		}
+		return
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close() // unblock the Scan below once the encoder is stopping
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(splitNALs)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	var au bytes.Buffer
+	for scanner.Scan() {
+		nal := scanner.Bytes()
+		if len(nal) < 4 {
+			continue
+		}
+		nalType := nal[3] & 0x1f
+		if nalType == audNALType && au.Len() > 0 {
+			publishAU(hub, au.Bytes())
+			au.Reset()
+		}
+		au.Write(nal)
+	}
+	if au.Len() > 0 {
+		publishAU(hub, au.Bytes())
+	}
+
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("WEBRTC: h264 ingest for stream ended: %v", err)
+	}
+}
+
+// publishAU copies buf, since au's backing array is reused once au is reset
+// for the next access unit.
+func publishAU(hub *Hub, buf []byte) {
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	hub.publish(media.Sample{Data: data, Duration: frameDuration})
+}
+
+// splitNALs is a bufio.Scanner split function that tokenizes an Annex-B
+// H.264 stream into individual NAL units, each returned with its leading
+// start code intact (as pion's H.264 depacketizer and our AUD detection
+// both expect). It mirrors client/main.go's scanJPEG: find the next marker
+// to know where the current token ends, and fall back to "it's the rest of
+// the stream" at EOF.
+func splitNALs(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	start := indexStartCode(data, 0)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil // trailing garbage with no start code; discard it
+		}
+		return 0, nil, nil
+	}
+
+	next := indexStartCode(data, start+3)
+	if next < 0 {
+		if atEOF {
+			return len(data), data[start:], nil
+		}
+		return 0, nil, nil // need more data to find where this NAL ends
+	}
+	return next, data[start:next], nil
+}
+
+// indexStartCode returns the index of the next Annex-B start code
+// (0x00 0x00 0x01) at or after from, or -1 if none is found. It also
+// matches the 4-byte 0x00 0x00 0x00 0x01 form, since that contains a
+// 3-byte start code at its second byte.
+func indexStartCode(data []byte, from int) int {
+	if from >= len(data) {
+		return -1
+	}
+	marker := []byte{0x00, 0x00, 0x01}
+	if i := bytes.Index(data[from:], marker); i >= 0 {
+		return from + i
+	}
+	return -1
+}
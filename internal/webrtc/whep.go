@@ -0,0 +1,75 @@
+package webrtc
+
+import (
+	"fmt"
+
+	pion "github.com/pion/webrtc/v4"
+)
+
+// Answer negotiates one WHEP viewer session for streamName: it applies
+// offerSDP as the remote description, creates a video track fed by that
+// stream's Hub, and returns the SDP answer once ICE candidate gathering
+// completes. The caller (handleWHEP in package main's whep.go) is expected to have already
+// ensured the stream's encoder is running via touchStream before calling
+// this, the same way handleHLSFile does for segment requests.
+func Answer(streamName string, offerSDP []byte) ([]byte, error) {
+	pc, err := pion.NewPeerConnection(pion.Configuration{
+		ICEServers: []pion.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create peer connection: %w", err)
+	}
+
+	track, err := pion.NewTrackLocalStaticSample(
+		pion.RTPCodecCapability{MimeType: pion.MimeTypeH264},
+		"video", streamName,
+	)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("could not create viewer track: %w", err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("could not add viewer track: %w", err)
+	}
+
+	hub := GetOrCreateHub(streamName)
+	hub.addTrack(track)
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		if state == pion.PeerConnectionStateClosed || state == pion.PeerConnectionStateFailed ||
+			state == pion.PeerConnectionStateDisconnected {
+			hub.removeTrack(track)
+			pc.Close()
+		}
+	})
+
+	if err := pc.SetRemoteDescription(pion.SessionDescription{
+		Type: pion.SDPTypeOffer,
+		SDP:  string(offerSDP),
+	}); err != nil {
+		hub.removeTrack(track)
+		pc.Close()
+		return nil, fmt.Errorf("could not apply SDP offer: %w", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		hub.removeTrack(track)
+		pc.Close()
+		return nil, fmt.Errorf("could not create SDP answer: %w", err)
+	}
+
+	// Gathering completes once pc.SetLocalDescription starts ICE candidate
+	// collection; waiting for it lets us return one self-contained SDP
+	// answer rather than trickling candidates over a signaling channel WHEP
+	// doesn't have.
+	gatherComplete := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		hub.removeTrack(track)
+		pc.Close()
+		return nil, fmt.Errorf("could not set local description: %w", err)
+	}
+	<-gatherComplete
+
+	return []byte(pc.LocalDescription().SDP), nil
+}
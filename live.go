@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mjpegBoundary is the multipart boundary used for the browser-native
+// multipart/x-mixed-replace live stream.
+const mjpegBoundary = "mjpegframe"
+
+// handleLiveStream serves the currently-ingesting stream to a viewer as
+// multipart/x-mixed-replace, pushing each frame published to the stream's
+// Hub as it arrives. It returns 404 if the stream is not currently live.
+func handleLiveStream(c *gin.Context) {
+	streamName := c.Param("stream_name")
+
+	hub, ok := getHub(streamName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "stream is not currently live"})
+		return
+	}
+
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+
+	c.Writer.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	c.Writer.WriteHeader(http.StatusOK)
+
+	flusher, canFlush := c.Writer.(http.Flusher)
+
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				// Hub was torn down because ingest ended.
+				return
+			}
+			if _, err := fmt.Fprintf(c.Writer, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := c.Writer.Write(frame); err != nil {
+				return
+			}
+			if _, err := c.Writer.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		case <-c.Request.Context().Done():
+			log.Printf("LIVE: viewer for %s disconnected", streamName)
+			return
+		}
+	}
+}
+
+// handleHLSFile serves the HLS master playlist, per-rendition playlists and
+// segment files for a live stream out of /mnt/nfs/streams/hls/<stream>,
+// starting (or keeping alive) that stream's ladder transcoder on access.
+//
+// file is everything after :stream_name, e.g. "/playlist.m3u8" for the
+// master playlist or "/720p/segment003.ts" for a rendition's segment.
+func handleHLSFile(c *gin.Context) {
+	streamName := c.Param("stream_name")
+	file := c.Param("file")
+
+	if !validStreamName(streamName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid stream_name"})
+		return
+	}
+	if file == "" || file == "/" || strings.Contains(file, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file path"})
+		return
+	}
+
+	if _, err := touchStream(streamName); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.File(filepath.Join("/mnt/nfs/streams/hls", streamName, file))
+}
@@ -4,20 +4,24 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"flag"
 
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
@@ -27,14 +31,67 @@ type archiveFrame struct {
 	Data []byte
 }
 
+// validStreamName reports whether name is safe to use as a path component
+// when building archive keys and on-disk paths (hlsPath, the WebRTC socket
+// path, etc.) — it must not be empty or contain a path separator or "..",
+// since stream names come straight from the URL and are never otherwise
+// sanitized before reaching filepath.Join.
+func validStreamName(name string) bool {
+	return name != "" && !strings.Contains(name, "..") && !strings.ContainsAny(name, "/\\")
+}
+
 var verbose *bool
 
+// archiveBackend is where rotated jpeg archive tars (and their .idx
+// sidecars) are written and read back from. See backend.go.
+var archiveBackend ArchiveBackend
+
+// requiredAuthToken, if set, is the Bearer token that POST /stream/:stream_name
+// must present. Empty means no authentication is enforced.
+var requiredAuthToken string
+
+// serverAckInterval is how often handleStream writes an X-Server-Ack chunk
+// back to the client while ingesting, the backpressure signal the client
+// streamer uses to decide when it's falling behind.
+const serverAckInterval = 500 * time.Millisecond
+
 func main() {
 	log.Println("Starting mjpeg-service")
 
 	verbose = flag.Bool("verbose", false, "Enable verbose ffmpeg logs.")
+	streamIdleTimeout := flag.Duration("stream-idle-timeout", 30*time.Second, "How long an HLS rendition ladder can go without a viewer request before its ffmpeg process is killed.")
+	archiveBackendKind := flag.String("archive-backend", envDefault("ARCHIVE_BACKEND", "local"), `Archive storage backend: "local" or "s3".`)
+	archiveRoot := flag.String("archive-root", envDefault("ARCHIVE_ROOT", "/mnt/nfs/streams"), "Root directory for the local archive backend.")
+	archiveBucket := flag.String("archive-bucket", envDefault("ARCHIVE_BUCKET", ""), "S3 bucket for the s3 archive backend.")
+	archivePrefix := flag.String("archive-prefix", envDefault("ARCHIVE_PREFIX", "streams/"), "Key prefix for the s3 archive backend. Call sites join their own \"jpeg/<stream>\" onto this, so it should not itself end in \"jpeg/\".")
+	authToken := flag.String("auth-token", envDefault("AUTH_TOKEN", ""), "If set, require this Bearer token on incoming /stream POSTs.")
 	flag.Parse()
 
+	requiredAuthToken = *authToken
+
+	switch *archiveBackendKind {
+	case "local":
+		archiveBackend = newLocalBackend(*archiveRoot)
+	case "s3":
+		if *archiveBucket == "" {
+			log.Fatal("--archive-bucket (or ARCHIVE_BUCKET) is required when --archive-backend=s3")
+		}
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		archiveBackend = newS3Backend(s3.NewFromConfig(cfg), *archiveBucket, *archivePrefix)
+		log.Printf("WARNING: with --archive-backend=s3, /image lookups against the current, " +
+			"still-open ~60s tar return the last frame of the newest completed tar (or 404 if " +
+			"there is none) until it rotates or the stream ends, since S3 objects " +
+			"aren't visible to GetObject/HeadObject/List until their upload completes. The local " +
+			"backend doesn't have this gap. See s3Backend's doc comment in backend_s3.go.")
+	default:
+		log.Fatalf("Unknown --archive-backend %q", *archiveBackendKind)
+	}
+
+	go reapIdleStreams(*streamIdleTimeout)
+
 	router := gin.Default()
 
 	router.Use(func(c *gin.Context) {
@@ -47,12 +104,19 @@ func main() {
 	})
 	router.POST("/stream/:stream_name", handleStream)
 	router.GET("/image/:stream_name/:timestamp", handleImageRequest)
+	router.GET("/live/:stream_name", handleLiveStream)
+	router.GET("/hls/:stream_name/*file", handleHLSFile)
+	router.POST("/whep/:stream_name", handleWHEP)
 
 	router.Run(":8080")
 }
 
 func handleImageRequest(c *gin.Context) {
 	streamName := c.Param("stream_name")
+	if !validStreamName(streamName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid stream_name"})
+		return
+	}
 	timestampStr := c.Param("timestamp")
 
 	timestampMs, err := strconv.ParseInt(timestampStr, 10, 64)
@@ -61,140 +125,99 @@ func handleImageRequest(c *gin.Context) {
 		return
 	}
 
-	jpegPath := filepath.Join("/mnt/nfs/streams/jpeg", streamName)
+	archivePrefix := path.Join("jpeg", streamName)
 
-	files, err := os.ReadDir(jpegPath)
+	objects, err := archiveBackend.List(archivePrefix)
 	if err != nil {
-		log.Printf("Failed to read directory %s: %v", jpegPath, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read stream directory"})
+		log.Printf("Failed to list archives under %s: %v", archivePrefix, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not list stream archives"})
 		return
 	}
 
-	var bestTarPath string
+	var bestTarKey string
 	var maxTarTimestampMs int64 = -1
 
-	for _, file := range files {
-		if file.IsDir() {
+	for _, obj := range objects {
+		fileName := path.Base(obj.Name)
+		if !strings.HasSuffix(fileName, ".tar") {
+			continue
+		}
+		base := strings.TrimSuffix(fileName, ".tar")
+		parts := strings.Split(base, "_")
+		if len(parts) < 2 {
+			continue
+		}
+		tarTimestampStr := parts[len(parts)-1]
+		tarTimestampMs, err := strconv.ParseInt(tarTimestampStr, 10, 64)
+		if err != nil {
 			continue
 		}
-		fileName := file.Name()
-		if strings.HasSuffix(fileName, ".tar") {
-			base := strings.TrimSuffix(fileName, ".tar")
-			parts := strings.Split(base, "_")
-			if len(parts) < 2 {
-				continue
-			}
-			tarTimestampStr := parts[len(parts)-1]
-			tarTimestampMs, err := strconv.ParseInt(tarTimestampStr, 10, 64)
-			if err != nil {
-				continue
-			}
 
-			// Find the latest tar file whose timestamp is <= the requested image timestamp
-			if tarTimestampMs <= timestampMs && tarTimestampMs > maxTarTimestampMs {
-				maxTarTimestampMs = tarTimestampMs
-				bestTarPath = filepath.Join(jpegPath, fileName)
-			}
+		// Find the latest tar file whose timestamp is <= the requested image timestamp
+		if tarTimestampMs <= timestampMs && tarTimestampMs > maxTarTimestampMs {
+			maxTarTimestampMs = tarTimestampMs
+			bestTarKey = obj.Name
 		}
 	}
 
-	if bestTarPath == "" {
+	if bestTarKey == "" {
 		c.JSON(http.StatusNotFound, gin.H{"error": "No archive file found covering the given timestamp"})
 		return
 	}
 
-	file, err := os.Open(bestTarPath)
+	entries, err := loadIndex(archiveBackend, idxKeyForTar(bestTarKey))
 	if err != nil {
-		log.Printf("Failed to open tar file %s: %v", bestTarPath, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open archive file"})
+		log.Printf("Failed to load index for %s: %v", bestTarKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read archive index"})
 		return
 	}
-	defer file.Close()
-
-	r := tar.NewReader(file)
 
-	var lastValidFrameData []byte
-
-	for {
-		hdr, err := r.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
-		if err != nil {
-			log.Printf("Error reading tar header in %s: %v", bestTarPath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read archive file"})
-			return
-		}
-
-		if hdr.Typeflag == tar.TypeReg {
-			frameNameWithoutExt := strings.TrimSuffix(hdr.Name, ".jpg")
-			frameTimestampMs, err := strconv.ParseInt(frameNameWithoutExt, 10, 64)
-			if err != nil {
-				log.Printf("Warning: Could not parse timestamp from frame name %s in tar: %v", hdr.Name, err)
-				// Discard data and continue to next entry if timestamp is unparseable
-				if _, err := io.Copy(io.Discard, r); err != nil {
-					log.Printf("Error discarding invalid frame data for %s: %v", hdr.Name, err)
-				}
-				continue
-			}
+	entry, ok := findFrame(entries, timestampMs)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No image found in archive matching or preceding the timestamp"})
+		return
+	}
 
-			if frameTimestampMs <= timestampMs {
-				// This frame is a candidate. Read its data.
-				buf := new(bytes.Buffer)
-				if _, err := io.Copy(buf, r); err != nil {
-					log.Printf("Error reading frame data for %s: %v", hdr.Name, err)
-					continue // Skip this frame if data can't be read
-				}
-				lastValidFrameData = buf.Bytes()
-			} else {
-				// This frame's timestamp is *greater than* the requested timestamp.
-				// Since frames are chronological, any subsequent frames will also be too new.
-				// So, we have found the latest valid frame in `lastValidFrameData` (if any).
-				// We can break here.
-				if _, err := io.Copy(io.Discard, r); err != nil { // Still need to discard this one
-					log.Printf("Error discarding frame data for %s: %v", hdr.Name, err)
-				}
-				break
-			}
-		} else {
-			// Discard non-regular file entries
-			if _, err := io.Copy(io.Discard, r); err != nil {
-				log.Printf("Error discarding non-regular entry %s: %v", hdr.Name, err)
-			}
-		}
+	ra, _, err := archiveBackend.Open(bestTarKey)
+	if err != nil {
+		log.Printf("Failed to open tar file %s: %v", bestTarKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open archive file"})
+		return
 	}
+	defer closeIfCloser(ra)
 
-	if lastValidFrameData != nil {
-		c.Header("Content-Type", "image/jpeg")
-		c.Status(http.StatusOK)
-		if _, err := c.Writer.Write(lastValidFrameData); err != nil {
-			log.Printf("Error writing image data to response: %v", err)
-		}
+	frameData := make([]byte, entry.Size)
+	if _, err := ra.ReadAt(frameData, entry.TarOffset); err != nil {
+		log.Printf("Failed to read frame at offset %d in %s: %v", entry.TarOffset, bestTarKey, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read frame from archive file"})
 		return
 	}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "No image found in archive matching or preceding the timestamp"})
+	c.Header("Content-Type", "image/jpeg")
+	c.Status(http.StatusOK)
+	if _, err := c.Writer.Write(frameData); err != nil {
+		log.Printf("Error writing image data to response: %v", err)
+	}
 }
 
 func handleStream(c *gin.Context) {
 	streamName := c.Param("stream_name")
-	if streamName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "stream_name is required"})
+	if !validStreamName(streamName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid stream_name"})
 		return
 	}
 
-	jpegPath := filepath.Join("/mnt/nfs/streams/jpeg", streamName)
-	hlsPath := filepath.Join("/mnt/nfs/streams/hls", streamName)
-
-	// Create directories for the streams and clean up old ones
-	if err := os.RemoveAll(jpegPath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not clean up JPEG stream directory"})
-		return
-	}
-	if err := os.MkdirAll(jpegPath, 0755); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create JPEG stream directory"})
+	if requiredAuthToken != "" && c.Request.Header.Get("Authorization") != "Bearer "+requiredAuthToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid Authorization header"})
 		return
 	}
+
+	archivePrefix := path.Join("jpeg", streamName)
+	hlsPath := filepath.Join("/mnt/nfs/streams/hls", streamName)
+
+	// Clean up the old HLS directory; the jpeg archive itself is managed
+	// through archiveBackend and doesn't need a local directory to exist
+	// up front (local backends create it lazily on first Create).
 	if err := os.RemoveAll(hlsPath); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not clean up HLS stream directory"})
 		return
@@ -208,51 +231,14 @@ func handleStream(c *gin.Context) {
 	archiveCh := make(chan archiveFrame, 300) // Buffer for ~60 seconds of frames at 5fps
 
 	// Start the background worker to write frames to a TAR archive.
-	go archiveWriter(c.Request.Context(), jpegPath, streamName, archiveCh)
-
-	// --- FFMPEG setup ---
-	ffmpegArgs := []string{
-		"-f", "mjpeg",
-		"-framerate", "5",
-		"-i", "-",
-		"-c:v", "libx264",
-		"-preset", "veryfast",
-		"-tune", "zerolatency",
-		"-crf", "23",
-		"-g", "10",
-		"-hls_time", "2",
-		"-hls_list_size", "5",
-		"-hls_flags", "delete_segments",
-		"-flush_packets", "1",
-		"-hls_segment_filename", filepath.Join(hlsPath, "segment%03d.ts"),
-		filepath.Join(hlsPath, "playlist.m3u8"),
-	}
-	if !*verbose {
-		ffmpegArgs = append([]string{"-loglevel", "error"}, ffmpegArgs...)
-	}
-	cmd := exec.CommandContext(c.Request.Context(), "ffmpeg", ffmpegArgs...)
+	go archiveWriter(c.Request.Context(), archiveBackend, archivePrefix, streamName, archiveCh)
 
-	ffmpegStdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Printf("Failed to get stdin pipe for ffmpeg: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to setup ffmpeg"})
-		return
-	}
-	defer ffmpegStdin.Close()
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start ffmpeg: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start ffmpeg"})
-		return
-	}
-
-	ffmpegDone := make(chan error, 1)
-	go func() {
-		ffmpegDone <- cmd.Wait()
-	}()
+	// Register a Hub so viewers can watch this stream live, and so the HLS
+	// transcoder (started lazily on the first playlist/segment request) has
+	// frames to feed its ffmpeg ladder. Torn down once ingest finishes.
+	hub := getOrCreateHub(streamName)
+	defer removeHub(streamName)
+	defer stopStream(streamName)
 
 	// --- Multipart processing ---
 	mediaType, params, err := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
@@ -263,6 +249,17 @@ func handleStream(c *gin.Context) {
 
 	mr := multipart.NewReader(c.Request.Body, params["boundary"])
 
+	// Start the response now (rather than only at the end) so we can stream
+	// X-Server-Ack chunks back to the client while still reading its request
+	// body; this is the backpressure signal the client streamer throttles on.
+	c.Writer.WriteHeader(http.StatusOK)
+	var lastIngestedMs int64
+	if flusher, ok := c.Writer.(http.Flusher); ok {
+		ackCtx, cancelAcks := context.WithCancel(c.Request.Context())
+		defer cancelAcks()
+		go sendServerAcks(ackCtx, c.Writer, flusher, &lastIngestedMs)
+	}
+
 	for {
 		p, err := mr.NextPart()
 		if err == io.EOF {
@@ -280,6 +277,9 @@ func handleStream(c *gin.Context) {
 			log.Printf("Multipart part missing X-Client-Timestamp header.")
 			continue
 		}
+		if ms, err := strconv.ParseInt(clientTimestamp, 10, 64); err == nil {
+			atomic.StoreInt64(&lastIngestedMs, ms)
+		}
 
 		// Read the frame into a buffer so we can send it to multiple places.
 		var frameData bytes.Buffer
@@ -296,35 +296,65 @@ func handleStream(c *gin.Context) {
 			log.Printf("Archive channel is full. Dropping frame %s for archival to prioritize live stream.", clientTimestamp)
 		}
 
-		// Write the frame to ffmpeg for HLS processing.
-		if _, err := ffmpegStdin.Write(frameData.Bytes()); err != nil {
-			if c.Request.Context().Err() == nil {
-				log.Printf("Error writing frame to ffmpeg: %v", err)
-			}
-			break
-		}
+		// Fan the frame out to any viewers watching this stream live, and to
+		// the HLS transcoder's ffmpeg stdin if one is currently running.
+		hub.publish(frameData.Bytes())
 	}
 
 	// Signal the archiver that no more frames are coming.
 	close(archiveCh)
 
-	// Ffmpeg will exit once its stdin is closed.
-	err = <-ffmpegDone
-	if err != nil && c.Request.Context().Err() != context.Canceled {
-		log.Printf("ffmpeg command finished with error: %v", err)
+	log.Printf("Finished processing stream for %s", streamName)
+}
+
+// sendServerAcks periodically writes the last ingested frame's timestamp to
+// w as a chunked "X-Server-Ack: <unixMs>\n" line, so the client streamer can
+// measure and react to ack lag. It runs until ctx is done.
+func sendServerAcks(ctx context.Context, w io.Writer, flusher http.Flusher, lastIngestedMs *int64) {
+	ticker := time.NewTicker(serverAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ms := atomic.LoadInt64(lastIngestedMs)
+			if ms == 0 {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "X-Server-Ack: %d\n", ms); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	log.Printf("Finished processing stream for %s", streamName)
-	c.Status(http.StatusOK)
+// countingWriteCloser tracks the total number of bytes written so far, which
+// is how archiveWriter learns each frame's tar offset without needing the
+// backend's writer to be seekable (an S3 multipart upload isn't).
+type countingWriteCloser struct {
+	w io.WriteCloser
+	n int64
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
-// archiveWriter receives frames from a channel and writes them to a TAR file,
-// creating a new file every 60 seconds.
-func archiveWriter(ctx context.Context, path, streamName string, ch <-chan archiveFrame) {
+func (c *countingWriteCloser) Close() error { return c.w.Close() }
+
+// archiveWriter receives frames from a channel and writes them, via backend,
+// to a TAR file under prefix, creating a new file every 60 seconds and
+// maintaining a ".idx" sidecar alongside it for O(log n) frame lookup.
+func archiveWriter(ctx context.Context, backend ArchiveBackend, prefix, streamName string, ch <-chan archiveFrame) {
 	log.Printf("Starting archive writer for stream %s", streamName)
 
-	var tarFile *os.File
+	var tarCloser *countingWriteCloser
 	var tarWriter *tar.Writer
+	var idxWriter io.WriteCloser
 	var currentTarStartMs int64 = -1 // Millisecond timestamp of the first frame in the current tar file.
 
 	// Close the writer and file when the function exits.
@@ -332,8 +362,11 @@ func archiveWriter(ctx context.Context, path, streamName string, ch <-chan archi
 		if tarWriter != nil {
 			tarWriter.Close()
 		}
-		if tarFile != nil {
-			tarFile.Close()
+		if tarCloser != nil {
+			tarCloser.Close()
+		}
+		if idxWriter != nil {
+			idxWriter.Close()
 		}
 		log.Printf("Archive writer for stream %s stopped.", streamName)
 	}()
@@ -344,24 +377,37 @@ func archiveWriter(ctx context.Context, path, streamName string, ch <-chan archi
 		if tarWriter != nil {
 			tarWriter.Close()
 		}
-		if tarFile != nil {
-			tarFile.Close()
+		if tarCloser != nil {
+			tarCloser.Close()
+		}
+		if idxWriter != nil {
+			idxWriter.Close()
 		}
 
-		// Create a new file name with the start timestamp of the first frame in this archive.
-		newFileName := filepath.Join(path, streamName+"_"+strconv.FormatInt(startMs, 10)+".tar")
+		// Key the new archive with the start timestamp of the first frame in it.
+		tarKey := path.Join(prefix, streamName+"_"+strconv.FormatInt(startMs, 10)+".tar")
 
-		var err error
-		tarFile, err = os.Create(newFileName)
+		wc, err := backend.Create(tarKey)
 		if err != nil {
-			log.Printf("ARCHIVER: Failed to create new tar file %s: %v", newFileName, err)
-			tarFile = nil
+			log.Printf("ARCHIVER: Failed to create new tar file %s: %v", tarKey, err)
+			tarCloser = nil
 			tarWriter = nil
+			idxWriter = nil
 			return
 		}
-		tarWriter = tar.NewWriter(tarFile)
+		tarCloser = &countingWriteCloser{w: wc}
+		tarWriter = tar.NewWriter(tarCloser)
+
+		idxWriter, err = backend.Create(idxKeyForTar(tarKey))
+		if err != nil {
+			// The archive itself is still usable without its index; handleImageRequest
+			// falls back to an error for this tar rather than failing the whole archiver.
+			log.Printf("ARCHIVER: Failed to create index sidecar for %s: %v", tarKey, err)
+			idxWriter = nil
+		}
+
 		currentTarStartMs = startMs // Update the start timestamp for the new archive
-		log.Printf("ARCHIVER: Created new archive file: %s", newFileName)
+		log.Printf("ARCHIVER: Created new archive file: %s", tarKey)
 	}
 
 	for {
@@ -399,10 +445,23 @@ func archiveWriter(ctx context.Context, path, streamName string, ch <-chan archi
 				log.Printf("ARCHIVER: Failed to write tar header for %s: %v", frame.Name, err)
 				continue
 			}
+
+			// The data for this entry starts right after the header (and any
+			// padding) that was just written, which is exactly what handleImageRequest
+			// needs to ReadAt the frame directly out of the tar later.
+			dataOffset := tarCloser.n
+
 			if _, err := tarWriter.Write(frame.Data); err != nil {
 				log.Printf("ARCHIVER: Failed to write frame data for %s: %v", frame.Name, err)
 				continue
 			}
+
+			if idxWriter != nil {
+				entry := indexEntry{TimestampMs: frameTimestampMs, TarOffset: dataOffset, Size: int32(len(frame.Data))}
+				if err := appendIndexRecord(idxWriter, entry); err != nil {
+					log.Printf("ARCHIVER: Failed to append index record for %s: %v", frame.Name, err)
+				}
+			}
 		case <-ctx.Done():
 			// The request was cancelled.
 			return
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jameslagorga/mjpeg/internal/webrtc"
+)
+
+// rendition describes one variant in the adaptive-bitrate HLS ladder.
+type rendition struct {
+	Name    string // also the sub-directory ffmpeg writes this variant's playlist/segments into
+	Width   int
+	Height  int
+	Bitrate string // ffmpeg -b:v value, e.g. "800k"; empty means "copy the source encode"
+}
+
+// ladder is the fixed set of renditions produced for every stream. "source"
+// is passed through with -c:v copy rather than re-encoded.
+var ladder = []rendition{
+	{Name: "360p", Width: 640, Height: 360, Bitrate: "800k"},
+	{Name: "720p", Width: 1280, Height: 720, Bitrate: "2500k"},
+	{Name: "source"},
+}
+
+// maxSegmentsPerRendition bounds how many old .ts chunks we keep on disk per
+// rendition once ffmpeg's own "delete_segments" rolling window has slid past
+// them; it's a backstop against disk growth across restarts, not the primary
+// retention mechanism.
+const maxSegmentsPerRendition = 12
+
+// Stream is the on-demand HLS transcoder for a single camera. It subscribes
+// to that camera's Hub (see hub.go) and feeds received frames into a single
+// ffmpeg invocation that produces the full rendition ladder, plus a low-
+// latency H.264 elementary stream for WebRTC viewers (see internal/webrtc).
+// It is started lazily on the first playlist/segment or WHEP request and
+// killed by reapIdleStreams once no HLS or WHEP request has touched it for
+// the --stream-idle-timeout duration.
+type Stream struct {
+	name    string
+	hlsPath string
+
+	mu             sync.Mutex
+	cmd            *exec.Cmd
+	cancel         context.CancelFunc
+	lastAccess     time.Time
+	webrtcListener net.Listener
+}
+
+var (
+	streamsMu sync.Mutex
+	streams   = make(map[string]*Stream)
+)
+
+// touchStream returns the Stream for name, starting its ffmpeg ladder if it
+// isn't already running, and records that a viewer just accessed it.
+func touchStream(name string) (*Stream, error) {
+	if !validStreamName(name) {
+		return nil, fmt.Errorf("invalid stream name %q", name)
+	}
+
+	streamsMu.Lock()
+	s, ok := streams[name]
+	if !ok {
+		s = &Stream{name: name, hlsPath: filepath.Join("/mnt/nfs/streams/hls", name)}
+		streams[name] = s
+	}
+	streamsMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAccess = time.Now()
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// start launches the ladder ffmpeg process and a feeder goroutine that
+// copies frames from the stream's Hub into its stdin, plus the WebRTC
+// ingest goroutine that reads the same ffmpeg's extra H.264 output. Callers
+// must hold s.mu.
+func (s *Stream) start() error {
+	hub, ok := getHub(s.name)
+	if !ok {
+		return fmt.Errorf("stream %s is not currently being ingested", s.name)
+	}
+
+	for _, r := range ladder {
+		if err := os.MkdirAll(filepath.Join(s.hlsPath, r.Name), 0755); err != nil {
+			return fmt.Errorf("could not create rendition directory for %s: %w", r.Name, err)
+		}
+	}
+
+	sockPath := webrtcSocketPath(s.name)
+	os.Remove(sockPath) // drop a stale socket left behind by a prior, uncleanly stopped run
+	webrtcListener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return fmt.Errorf("could not open WebRTC ingest socket for %s: %w", s.name, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	args := ladderArgs(s.hlsPath, sockPath)
+	if !*verbose {
+		args = append([]string{"-loglevel", "error"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		webrtcListener.Close()
+		return fmt.Errorf("could not get ffmpeg stdin pipe: %w", err)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		webrtcListener.Close()
+		return fmt.Errorf("could not start ffmpeg: %w", err)
+	}
+
+	frameCh := hub.subscribe()
+	go func() {
+		defer hub.unsubscribe(frameCh)
+		defer stdin.Close()
+		for {
+			select {
+			case frame, ok := <-frameCh:
+				if !ok {
+					return
+				}
+				if _, err := stdin.Write(frame); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				// stop() cancelled us; don't wait on a Hub that may never
+				// publish again.
+				return
+			}
+		}
+	}()
+
+	go webrtc.Ingest(ctx, webrtcListener, webrtc.GetOrCreateHub(s.name))
+
+	s.cmd = cmd
+	s.cancel = cancel
+	s.webrtcListener = webrtcListener
+	log.Printf("TRANSCODER: started HLS ladder for %s", s.name)
+	return nil
+}
+
+// stop kills the ffmpeg process, if running, and waits for it to exit.
+func (s *Stream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil {
+		return
+	}
+	log.Printf("TRANSCODER: stopping HLS ladder for %s", s.name)
+	s.cancel()
+	s.cmd.Wait()
+	s.cmd = nil
+	s.cancel = nil
+	s.webrtcListener.Close() // unblocks Ingest's Accept if ffmpeg never connected
+	s.webrtcListener = nil
+	webrtc.RemoveHub(s.name)
+}
+
+// stopStream stops and forgets the transcoder for name, if one exists. Called
+// once ingest for the stream ends.
+func stopStream(name string) {
+	streamsMu.Lock()
+	s, ok := streams[name]
+	delete(streams, name)
+	streamsMu.Unlock()
+	if ok {
+		s.stop()
+	}
+}
+
+// webrtcRendition is the size and bitrate of the extra output ladderArgs
+// adds for WebRTC viewers. ladderArgs encodes it in baseline profile so
+// every browser's built-in decoder accepts it, zero-latency tuned, with
+// Access Unit Delimiters inserted so internal/webrtc.Ingest can find access
+// unit boundaries in the raw Annex-B stream without a container.
+var webrtcRendition = rendition{Name: "webrtc", Width: 1280, Height: 720, Bitrate: "2000k"}
+
+// webrtcSocketPath is the Unix socket a stream's ffmpeg ladder connects out
+// to with its raw H.264 output, and internal/webrtc.Ingest accepts on.
+func webrtcSocketPath(name string) string {
+	return filepath.Join(os.TempDir(), "mjpeg-webrtc-"+name+".sock")
+}
+
+// ladderArgs builds the ffmpeg arguments for a single invocation with two
+// outputs sharing one -filter_complex split of the incoming mjpeg input:
+// the HLS rendition ladder (a master playlist plus one sub-playlist and
+// segment set per rendition), and a second, separate output that sends one
+// extra H.264 elementary stream rendition to webrtcSockPath for
+// internal/webrtc to pick up.
+func ladderArgs(hlsPath, webrtcSockPath string) []string {
+	renditions := append(append([]rendition{}, ladder...), webrtcRendition)
+	webrtcIndex := len(renditions) - 1
+
+	var filters []string
+	splits := make([]string, len(renditions))
+	for i := range renditions {
+		splits[i] = fmt.Sprintf("[v%d]", i)
+	}
+	filters = append(filters, fmt.Sprintf("[0:v]split=%d%s", len(renditions), strings.Join(splits, "")))
+	for i, r := range renditions {
+		if r.Bitrate == "" {
+			filters = append(filters, fmt.Sprintf("[v%d]copy[vout%d]", i, i))
+		} else {
+			filters = append(filters, fmt.Sprintf("[v%d]scale=%d:%d[vout%d]", i, r.Width, r.Height, i))
+		}
+	}
+
+	args := []string{
+		"-f", "mjpeg",
+		"-framerate", "5",
+		"-i", "-",
+	}
+
+	// Output 1: the HLS ladder, unchanged from before the WebRTC rendition
+	// was added to the shared split above.
+	var streamMap []string
+	for i, r := range ladder {
+		if r.Bitrate == "" {
+			args = append(args, "-map", fmt.Sprintf("[vout%d]", i), fmt.Sprintf("-c:v:%d", i), "copy")
+		} else {
+			args = append(args, "-map", fmt.Sprintf("[vout%d]", i),
+				fmt.Sprintf("-c:v:%d", i), "libx264",
+				fmt.Sprintf("-b:v:%d", i), r.Bitrate,
+				"-preset", "veryfast", "-tune", "zerolatency", "-g", "10")
+		}
+		streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%s", i, r.Name))
+	}
+	args = append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-f", "hls",
+		"-hls_time", "2",
+		"-hls_list_size", "5",
+		"-hls_flags", "delete_segments",
+		"-flush_packets", "1",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-master_pl_name", "playlist.m3u8",
+		"-hls_segment_filename", filepath.Join(hlsPath, "%v", "segment%03d.ts"),
+		filepath.Join(hlsPath, "%v", "playlist.m3u8"),
+	)
+
+	// Output 2: the raw H.264 WebRTC rendition, its own output so it doesn't
+	// have to appear in the HLS muxer's var_stream_map above.
+	args = append(args,
+		"-map", fmt.Sprintf("[vout%d]", webrtcIndex),
+		"-c:v:0", "libx264",
+		"-b:v:0", webrtcRendition.Bitrate,
+		"-preset", "veryfast", "-tune", "zerolatency", "-g", "10",
+		"-profile:v:0", "baseline",
+		"-x264-params:0", "aud=1:repeat-headers=1",
+		"-f", "h264",
+		"unix:"+webrtcSockPath,
+	)
+	return args
+}
+
+// reapIdleStreams periodically kills the ffmpeg ladder for any stream that
+// hasn't been viewed in idle and prunes old segment files, so a camera with
+// no viewers stops burning CPU. It runs for the lifetime of the process.
+func reapIdleStreams(idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		streamsMu.Lock()
+		snapshot := make([]*Stream, 0, len(streams))
+		for _, s := range streams {
+			snapshot = append(snapshot, s)
+		}
+		streamsMu.Unlock()
+
+		for _, s := range snapshot {
+			s.mu.Lock()
+			idleTooLong := s.cmd != nil && time.Since(s.lastAccess) > idle
+			hlsPath := s.hlsPath
+			s.mu.Unlock()
+
+			if idleTooLong {
+				s.stop()
+			}
+			pruneOldSegments(hlsPath)
+		}
+	}
+}
+
+// pruneOldSegments removes all but the newest maxSegmentsPerRendition .ts
+// files in each rendition sub-directory of hlsPath.
+func pruneOldSegments(hlsPath string) {
+	for _, r := range ladder {
+		dir := filepath.Join(hlsPath, r.Name)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		var segments []os.DirEntry
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".ts") {
+				segments = append(segments, e)
+			}
+		}
+		sort.Slice(segments, func(i, j int) bool { return segments[i].Name() < segments[j].Name() })
+
+		if excess := len(segments) - maxSegmentsPerRendition; excess > 0 {
+			for _, e := range segments[:excess] {
+				if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+					log.Printf("TRANSCODER: failed to prune old segment %s: %v", e.Name(), err)
+				}
+			}
+		}
+	}
+}
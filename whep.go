@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jameslagorga/mjpeg/internal/webrtc"
+)
+
+// handleWHEP implements the WHEP (WebRTC-HTTP Egress Protocol) playback
+// endpoint: a browser POSTs its SDP offer as the request body and gets the
+// SDP answer back, same request/response shape as handleHLSFile's segment
+// requests start (or keep alive) the stream's ladder transcoder, since the
+// WebRTC rendition it produces is what internal/webrtc.Ingest reads.
+func handleWHEP(c *gin.Context) {
+	streamName := c.Param("stream_name")
+
+	if _, err := touchStream(streamName); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	offer, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read SDP offer"})
+		return
+	}
+
+	answer, err := webrtc.Answer(streamName, offer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusCreated, "application/sdp", answer)
+}